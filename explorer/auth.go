@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// --- Auth / CORS ---
+//
+// The explorer is meant to run behind a single shared secret: a header
+// token checked before any temp dir or subprocess work happens, plus an
+// explicit CORS origin allowlist in place of the old wildcard. Both are
+// configured via environment variables so the binary itself needs no
+// flags to lock down.
+
+const (
+	// tokenEnvVar names the env var holding the shared-secret token.
+	// If unset, CHIBICC_EXPLORER_TOKEN_FILE is tried next; if neither is
+	// set, auth is disabled (local/dev mode).
+	tokenEnvVar     = "CHIBICC_EXPLORER_TOKEN"
+	tokenFileEnvVar = "CHIBICC_EXPLORER_TOKEN_FILE"
+
+	// originsEnvVar is a comma-separated list of origins allowed to make
+	// cross-origin requests, e.g. "https://example.com,https://foo.dev".
+	// An empty/unset list means no cross-origin requests are allowed;
+	// same-origin requests are unaffected either way.
+	originsEnvVar = "CHIBICC_EXPLORER_ALLOWED_ORIGINS"
+
+	tokenHeader = "X-Chibicc-Token"
+)
+
+var (
+	authToken      string
+	allowedOrigins map[string]bool
+)
+
+// loadAuthConfig reads the token and origin allowlist from the
+// environment. It must be called once before the server starts
+// accepting requests.
+func loadAuthConfig() {
+	authToken = os.Getenv(tokenEnvVar)
+	if authToken == "" {
+		if path := os.Getenv(tokenFileEnvVar); path != "" {
+			if data, err := os.ReadFile(path); err == nil {
+				authToken = strings.TrimSpace(string(data))
+			}
+		}
+	}
+
+	allowedOrigins = make(map[string]bool)
+	for _, origin := range strings.Split(os.Getenv(originsEnvVar), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			allowedOrigins[origin] = true
+		}
+	}
+
+	if authToken == "" {
+		log.Printf("WARNING: no auth token configured (%s / %s unset) — every /api endpoint is open to anyone who can reach this server", tokenEnvVar, tokenFileEnvVar)
+	}
+}
+
+// tokenMatches compares provided against the configured authToken in
+// constant time (via equal-length SHA-256 digests) so a timing attack
+// can't be used to recover the token byte by byte.
+func tokenMatches(provided string) bool {
+	want := sha256.Sum256([]byte(authToken))
+	got := sha256.Sum256([]byte(provided))
+	return subtle.ConstantTimeCompare(want[:], got[:]) == 1
+}
+
+// isLoopbackAddr reports whether a "host:port" listen address only
+// accepts connections from the local machine. An empty host (as in
+// ":8001") binds every interface, so it is NOT loopback-only.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	return net.ParseIP(host).IsLoopback()
+}
+
+// applyCORS sets the Access-Control-* response headers when the request's
+// Origin is on the allowlist; it is a no-op for same-origin requests or
+// disallowed origins.
+func applyCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !allowedOrigins[origin] {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Vary", "Origin")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+tokenHeader)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+}
+
+// withAuth wraps an API handler with CORS handling, OPTIONS preflight,
+// and shared-secret token enforcement. Unauthorized or preflight
+// requests are rejected/answered before next ever runs, so they never
+// reach the temp dir / subprocess work.
+func withAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applyCORS(w, r)
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if authToken != "" && !tokenMatches(r.Header.Get(tokenHeader)) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// --- Multi-file build ---
+//
+// handleBuild accepts a multipart POST carrying a project tree (as a tar,
+// tar.gz, or zip archive) plus a JSON manifest describing how to compile
+// it, mirroring the build-context-plus-options shape of container image
+// build endpoints. Unlike handleCompile's single in-memory string, this
+// lets a request exercise #include "foo.h", multiple translation units,
+// and -D/-I driven preprocessing.
+
+// BuildManifest describes how the uploaded archive should be compiled.
+type BuildManifest struct {
+	// Entry is the archive-relative path to the translation unit that
+	// codegen runs against, e.g. "src/main.c".
+	Entry string `json:"entry"`
+	// IncludeDirs are archive-relative directories passed as -I.
+	IncludeDirs []string `json:"include_dirs,omitempty"`
+	// Defines are passed as -D, either "NAME" or "NAME=VALUE".
+	Defines []string `json:"defines,omitempty"`
+	// Flags are extra chibicc flags appended verbatim.
+	Flags []string `json:"flags,omitempty"`
+	// TimeoutMs optionally overrides defaultCmdTimeout for the whole
+	// build, capped by maxCmdTimeout. The ?timeout_ms= query param
+	// takes precedence if both are set.
+	TimeoutMs int `json:"timeout_ms,omitempty"`
+}
+
+// BuildFileResult holds the tokenize/parse output for one source file in
+// the archive. Codegen and preprocessing only ever run against the
+// manifest's entry file, so they aren't duplicated here; see
+// BuildResponse.Assembly and BuildResponse.Preprocessed.
+type BuildFileResult struct {
+	Tokens json.RawMessage        `json:"tokens"`
+	AST    json.RawMessage        `json:"ast"`
+	Stages map[string]*StageStats `json:"stages"`
+	Error  *string                `json:"error,omitempty"`
+}
+
+type BuildResponse struct {
+	Entry        string                      `json:"entry"`
+	Files        map[string]*BuildFileResult `json:"files"`
+	Preprocessed string                      `json:"preprocessed"`
+	Assembly     string                      `json:"assembly"`
+	Stages       map[string]*StageStats      `json:"stages"`
+	Error        *string                     `json:"error,omitempty"`
+}
+
+// maxArchiveMemory bounds the in-memory portion of the multipart parse.
+// handleBuild then reads the whole archive into memory before extracting
+// it to disk.
+const maxArchiveMemory = 32 << 20
+
+func handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxArchiveMemory); err != nil {
+		http.Error(w, "invalid multipart form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var manifest BuildManifest
+	if m := r.FormValue("manifest"); m != "" {
+		if err := json.Unmarshal([]byte(m), &manifest); err != nil {
+			http.Error(w, "invalid manifest JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if manifest.Entry == "" {
+		http.Error(w, "manifest.entry is required", http.StatusBadRequest)
+		return
+	}
+
+	archiveFile, header, err := r.FormFile("archive")
+	if err != nil {
+		http.Error(w, "missing archive file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer archiveFile.Close()
+
+	archiveBytes, err := io.ReadAll(archiveFile)
+	if err != nil {
+		http.Error(w, "failed to read archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "chibicc-build-*")
+	if err != nil {
+		http.Error(w, "failed to create temp dir", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if isZipArchive(header.Filename, archiveBytes) {
+		err = extractZip(archiveBytes, tmpDir)
+	} else {
+		err = extractTar(archiveBytes, tmpDir)
+	}
+	if err != nil {
+		http.Error(w, "failed to extract archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entryPath, err := safeJoin(tmpDir, manifest.Entry)
+	if err != nil {
+		http.Error(w, "invalid manifest.entry: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(entryPath); err != nil {
+		http.Error(w, "entry file not found in archive: "+manifest.Entry, http.StatusBadRequest)
+		return
+	}
+
+	extraArgs, err := manifestArgs(manifest, tmpDir)
+	if err != nil {
+		http.Error(w, "invalid manifest.include_dirs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sourceFiles, err := findSourceFiles(tmpDir)
+	if err != nil {
+		http.Error(w, "failed to walk archive: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := BuildResponse{
+		Entry:  manifest.Entry,
+		Files:  make(map[string]*BuildFileResult, len(sourceFiles)),
+		Stages: make(map[string]*StageStats),
+	}
+
+	var errors []string
+
+	// One parent context for the whole build, same rationale as
+	// handleCompile: a client disconnect or deadline kills every
+	// in-flight stage across every file, not just the current one.
+	ctx, cancel := context.WithTimeout(r.Context(), resolveTimeout(r, manifest.TimeoutMs))
+	defer cancel()
+
+	for _, abs := range sourceFiles {
+		rel, _ := filepath.Rel(tmpDir, abs)
+		rel = filepath.ToSlash(rel)
+
+		result := &BuildFileResult{
+			Tokens: json.RawMessage("null"),
+			AST:    json.RawMessage("null"),
+			Stages: make(map[string]*StageStats),
+		}
+
+		tokStats, tokens, tokErr := tokenizeStage(ctx, abs, extraArgs)
+		result.Stages["tokenize"] = tokStats
+		if tokErr != "" {
+			errors = append(errors, fmt.Sprintf("%s: %s", rel, tokErr))
+			annotateStageErr(tokStats, ctx)
+			msg := tokErr
+			result.Error = &msg
+		} else {
+			result.Tokens = tokens
+		}
+
+		astStats, ast, astErr := parseStage(ctx, abs, extraArgs)
+		result.Stages["parse"] = astStats
+		if astErr != "" {
+			errors = append(errors, fmt.Sprintf("%s: %s", rel, astErr))
+			annotateStageErr(astStats, ctx)
+			if result.Error == nil {
+				msg := astErr
+				result.Error = &msg
+			}
+		} else {
+			result.AST = ast
+		}
+
+		resp.Files[rel] = result
+	}
+
+	preStats, preOut, preErr := preprocessStage(ctx, entryPath, extraArgs)
+	resp.Stages["preprocess"] = preStats
+	if preErr != "" {
+		errors = append(errors, preErr)
+		annotateStageErr(preStats, ctx)
+	} else {
+		resp.Preprocessed = preOut
+	}
+
+	asmFile := filepath.Join(tmpDir, "output.s")
+	codegenStats, asm, codegenErr := codegenStage(ctx, entryPath, asmFile, extraArgs)
+	resp.Stages["codegen"] = codegenStats
+	if codegenErr != "" {
+		errors = append(errors, codegenErr)
+		annotateStageErr(codegenStats, ctx)
+	} else {
+		resp.Assembly = asm
+	}
+
+	if len(errors) > 0 {
+		combined := strings.Join(errors, "\n")
+		resp.Error = &combined
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// manifestArgs turns include dirs / defines / extra flags into chibicc
+// command-line arguments rooted at tmpDir. Include dirs go through
+// safeJoin, the same archive-escape guard used during extraction, since
+// an unchecked "../../etc" would otherwise let -I reach outside tmpDir.
+func manifestArgs(m BuildManifest, tmpDir string) ([]string, error) {
+	var args []string
+	for _, dir := range m.IncludeDirs {
+		abs, err := safeJoin(tmpDir, dir)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-I"+abs)
+	}
+	for _, d := range m.Defines {
+		args = append(args, "-D"+d)
+	}
+	args = append(args, m.Flags...)
+	return args, nil
+}
+
+// findSourceFiles returns every .c file under root, sorted for
+// deterministic output.
+func findSourceFiles(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".c") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// isZipArchive decides whether the upload should be treated as a zip
+// rather than a tar(.gz), preferring the filename extension and falling
+// back to the zip magic number.
+func isZipArchive(filename string, data []byte) bool {
+	if strings.HasSuffix(strings.ToLower(filename), ".zip") {
+		return true
+	}
+	return len(data) >= 4 && data[0] == 'P' && data[1] == 'K' && data[2] == 0x03 && data[3] == 0x04
+}
+
+// extractTar unpacks a tar or gzip-compressed tar into destDir, rejecting
+// any entry that would escape destDir.
+func extractTar(data []byte, destDir string) error {
+	r := io.Reader(bytes.NewReader(data))
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := safeJoin(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		}
+	}
+}
+
+// extractZip unpacks a zip archive into destDir, rejecting any entry
+// that would escape destDir.
+func extractZip(data []byte, destDir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		target, err := safeJoin(destDir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		_, copyErr := io.Copy(out, rc)
+		rc.Close()
+		out.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+	}
+	return nil
+}
+
+// safeJoin joins name onto root and rejects the result if it would
+// escape root (a zip-slip / tar-slip guard).
+func safeJoin(root, name string) (string, error) {
+	target := filepath.Join(root, filepath.FromSlash(name))
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("illegal file path in archive: %s", name)
+	}
+	return target, nil
+}
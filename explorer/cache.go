@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Content-addressed compile cache ---
+//
+// compileCache memoizes handleCompile's CompileResponse, keyed by the
+// SHA-256 of the source plus the effective chibicc flag set. This is
+// aimed at the interactive explorer use case where a user retypes or
+// tweaks one character at a time: repeat requests for code already
+// compiled without errors skip the four subprocess spawns entirely;
+// responses with an error are not cached. The in-process tier is a
+// bounded LRU; an optional on-disk tier under os.TempDir() survives
+// process restarts at the cost of a filesystem round trip on a miss.
+
+type cacheEntry struct {
+	key       string
+	resp      *CompileResponse
+	createdAt time.Time
+	bytes     int
+}
+
+type compileCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front = most recently used
+
+	maxEntries     int
+	ttl            time.Duration
+	diskDir        string // empty disables the on-disk tier
+	diskMaxEntries int    // 0 means unbounded
+
+	hits, misses int64
+	totalBytes   int64
+}
+
+func newCompileCache(maxEntries int, ttl time.Duration, diskDir string, diskMaxEntries int) *compileCache {
+	if diskDir != "" {
+		os.MkdirAll(diskDir, 0755)
+	}
+	return &compileCache{
+		entries:        make(map[string]*list.Element),
+		order:          list.New(),
+		maxEntries:     maxEntries,
+		ttl:            ttl,
+		diskDir:        diskDir,
+		diskMaxEntries: diskMaxEntries,
+	}
+}
+
+// globalCache is configured from flags in main.
+var globalCache *compileCache
+
+// cacheKey hashes the source together with the effective flag set so
+// that two requests for the same code under different chibicc flags
+// don't collide.
+func cacheKey(code string, flags []string) string {
+	h := sha256.New()
+	h.Write([]byte(code))
+	for _, f := range flags {
+		h.Write([]byte{0})
+		h.Write([]byte(f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a cached response and true on a hit, checking the
+// in-process LRU first and falling back to the disk tier.
+func (c *compileCache) get(key string) (*CompileResponse, bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if time.Since(entry.createdAt) <= c.ttl {
+			c.order.MoveToFront(el)
+			c.hits++
+			c.mu.Unlock()
+			return entry.resp, true
+		}
+		c.removeExpiredLocked(key, el)
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	if resp, ok := c.loadDisk(key); ok {
+		c.set(key, resp)
+		return resp, true
+	}
+	return nil, false
+}
+
+// set stores resp under key, evicting the least-recently-used entry if
+// the cache is full, and writes through to the disk tier if enabled.
+func (c *compileCache) set(key string, resp *CompileResponse) {
+	encoded, err := json.Marshal(resp)
+	size := 0
+	if err == nil {
+		size = len(encoded)
+	}
+
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		old := el.Value.(*cacheEntry)
+		c.totalBytes -= int64(old.bytes)
+		el.Value = &cacheEntry{key: key, resp: resp, createdAt: time.Now(), bytes: size}
+		c.totalBytes += int64(size)
+		c.order.MoveToFront(el)
+	} else {
+		el := c.order.PushFront(&cacheEntry{key: key, resp: resp, createdAt: time.Now(), bytes: size})
+		c.entries[key] = el
+		c.totalBytes += int64(size)
+		for c.order.Len() > c.maxEntries {
+			oldest := c.order.Back()
+			if oldest == nil {
+				break
+			}
+			c.removeMemoryOnlyLocked(oldest.Value.(*cacheEntry).key, oldest)
+		}
+	}
+	c.mu.Unlock()
+
+	if c.diskDir != "" && err == nil {
+		os.WriteFile(filepath.Join(c.diskDir, key+".json"), encoded, 0644)
+		c.enforceDiskCap()
+	}
+}
+
+// enforceDiskCap bounds the on-disk tier's entry count, since it has no
+// in-memory LRU of its own and the "one keystroke, one new hash" explorer
+// workload would otherwise mint files forever. When over diskMaxEntries,
+// the oldest files (by mtime) are removed first.
+func (c *compileCache) enforceDiskCap() {
+	if c.diskMaxEntries <= 0 {
+		return
+	}
+	files, err := os.ReadDir(c.diskDir)
+	if err != nil || len(files) <= c.diskMaxEntries {
+		return
+	}
+
+	type fileAge struct {
+		name    string
+		modTime time.Time
+	}
+	aged := make([]fileAge, 0, len(files))
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		aged = append(aged, fileAge{name: f.Name(), modTime: info.ModTime()})
+	}
+	sort.Slice(aged, func(i, j int) bool { return aged[i].modTime.Before(aged[j].modTime) })
+
+	excess := len(aged) - c.diskMaxEntries
+	for i := 0; i < excess; i++ {
+		os.Remove(filepath.Join(c.diskDir, aged[i].name))
+	}
+}
+
+// removeMemoryOnlyLocked drops key from the in-memory map and LRU list
+// only. It backs the maxEntries overflow path in set(): falling out of
+// the hot in-memory tier is routine capacity management, not
+// invalidation, so the disk-tier copy (governed by its own
+// diskMaxEntries cap and TTL) must survive it. c.mu must already be
+// held.
+func (c *compileCache) removeMemoryOnlyLocked(key string, el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.totalBytes -= int64(entry.bytes)
+	delete(c.entries, key)
+	c.order.Remove(el)
+}
+
+// removeExpiredLocked drops key from the in-memory tier and deletes its
+// disk-tier file, if any. Unlike removeMemoryOnlyLocked, this means the
+// entry is actually invalid (TTL expiry) rather than merely evicted for
+// space, so both tiers must forget it. c.mu must already be held.
+func (c *compileCache) removeExpiredLocked(key string, el *list.Element) {
+	c.removeMemoryOnlyLocked(key, el)
+	if c.diskDir != "" {
+		os.Remove(filepath.Join(c.diskDir, key+".json"))
+	}
+}
+
+// loadDisk reads a disk-tier entry, honoring the same TTL as the
+// in-process cache and removing the file once it has expired.
+func (c *compileCache) loadDisk(key string) (*CompileResponse, bool) {
+	if c.diskDir == "" {
+		return nil, false
+	}
+	path := filepath.Join(c.diskDir, key+".json")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	if time.Since(info.ModTime()) > c.ttl {
+		os.Remove(path)
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var resp CompileResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+// purge empties both cache tiers and resets the hit/miss counters.
+func (c *compileCache) purge() {
+	c.mu.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.order = list.New()
+	c.hits, c.misses, c.totalBytes = 0, 0, 0
+	c.mu.Unlock()
+
+	if c.diskDir != "" {
+		if files, err := os.ReadDir(c.diskDir); err == nil {
+			for _, f := range files {
+				if strings.HasSuffix(f.Name(), ".json") {
+					os.Remove(filepath.Join(c.diskDir, f.Name()))
+				}
+			}
+		}
+	}
+}
+
+type cacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+func (c *compileCache) stats() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: len(c.entries),
+		Bytes:   c.totalBytes,
+	}
+}
+
+// withCached marks every stage in resp as served from cache, returning
+// a shallow copy so the cached original is never mutated.
+func withCached(resp *CompileResponse) *CompileResponse {
+	out := *resp
+	out.Stages = make(map[string]*StageStats, len(resp.Stages))
+	for name, stats := range resp.Stages {
+		copied := *stats
+		copied.Cached = true
+		out.Stages[name] = &copied
+	}
+	return &out
+}
+
+// --- Cache admin endpoints ---
+
+func handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(globalCache.stats())
+}
+
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	globalCache.purge()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(globalCache.stats())
+}
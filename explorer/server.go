@@ -3,27 +3,38 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 	"os/exec"
 )
 
 const (
-	chibiccBin  = "/home/exedev/chibicc/chibicc"
-	staticDir   = "/home/exedev/chibicc/explorer"
-	listenAddr  = ":8001"
-	cmdTimeout  = 5 * time.Second
+	chibiccBin = "/home/exedev/chibicc/chibicc"
+	staticDir  = "/home/exedev/chibicc/explorer"
+	listenAddr = ":8001"
+
+	// defaultCmdTimeout applies when a request specifies no timeout_ms.
+	defaultCmdTimeout = 5 * time.Second
+	// maxCmdTimeout caps whatever a request asks for.
+	maxCmdTimeout = 30 * time.Second
 )
 
 // --- Request / Response types ---
 
 type CompileRequest struct {
 	Code string `json:"code"`
+	// TimeoutMs optionally overrides defaultCmdTimeout for the whole
+	// pipeline, capped by maxCmdTimeout. The ?timeout_ms= query param
+	// takes precedence if both are set.
+	TimeoutMs int `json:"timeout_ms,omitempty"`
 }
 
 type StageStats struct {
@@ -38,7 +49,10 @@ type StageStats struct {
 	// codegen
 	Bytes int `json:"bytes,omitempty"`
 	// common
-	TimeMs float64 `json:"time_ms"`
+	TimeMs         float64 `json:"time_ms"`
+	TimedOut       bool    `json:"timed_out,omitempty"`
+	KilledByClient bool    `json:"killed_by_client,omitempty"`
+	Cached         bool    `json:"cached,omitempty"`
 }
 
 type CompileResponse struct {
@@ -62,6 +76,39 @@ func runCmd(ctx context.Context, name string, args ...string) (string, string, e
 	return stdout.String(), stderr.String(), err
 }
 
+// resolveTimeout picks the pipeline's overall deadline: the ?timeout_ms=
+// query param wins if present, otherwise requestMs (typically a JSON
+// field), otherwise defaultCmdTimeout. The result is always clamped to
+// maxCmdTimeout so a client can't hold a subprocess open indefinitely.
+func resolveTimeout(r *http.Request, requestMs int) time.Duration {
+	ms := requestMs
+	if q := r.URL.Query().Get("timeout_ms"); q != "" {
+		if v, err := strconv.Atoi(q); err == nil && v > 0 {
+			ms = v
+		}
+	}
+	if ms <= 0 {
+		return defaultCmdTimeout
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if d > maxCmdTimeout {
+		return maxCmdTimeout
+	}
+	return d
+}
+
+// annotateStageErr marks stats.TimedOut or stats.KilledByClient when a
+// stage failed because the shared pipeline context expired or the
+// client disconnected, rather than because chibicc itself errored.
+func annotateStageErr(stats *StageStats, ctx context.Context) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		stats.TimedOut = true
+	case errors.Is(ctx.Err(), context.Canceled):
+		stats.KilledByClient = true
+	}
+}
+
 // countASTNodes recursively counts objects with a "kind" field.
 func countASTNodes(v interface{}) int {
 	count := 0
@@ -106,6 +153,89 @@ func countFunctionsAndGlobals(astObj map[string]interface{}) (functions, globals
 	return
 }
 
+// --- Stage runners ---
+//
+// Each stage runner invokes one chibicc mode against srcFile and reports
+// timing via StageStats. extraArgs is inserted between the mode flag and
+// the "-cc1" passthrough (or before the source file for codegen) so that
+// callers such as handleBuild can thread in -I/-D flags; handleCompile
+// passes nil.
+
+func tokenizeStage(ctx context.Context, srcFile string, extraArgs []string) (*StageStats, json.RawMessage, string) {
+	start := time.Now()
+	args := append([]string{"--dump-tokens"}, extraArgs...)
+	args = append(args, "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/null", srcFile)
+	stdout, stderr, err := runCmd(ctx, chibiccBin, args...)
+	stats := &StageStats{TimeMs: float64(time.Since(start).Microseconds()) / 1000.0}
+	if err != nil {
+		return stats, json.RawMessage("null"), stageErrMsg("tokenize", stderr, err)
+	}
+	var tokens []interface{}
+	if jsonErr := json.Unmarshal([]byte(stdout), &tokens); jsonErr == nil {
+		stats.Count = len(tokens)
+	}
+	return stats, json.RawMessage(stdout), ""
+}
+
+func preprocessStage(ctx context.Context, srcFile string, extraArgs []string) (*StageStats, string, string) {
+	start := time.Now()
+	args := append([]string{"-E"}, extraArgs...)
+	args = append(args, "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/stdout", srcFile)
+	stdout, stderr, err := runCmd(ctx, chibiccBin, args...)
+	stats := &StageStats{TimeMs: float64(time.Since(start).Microseconds()) / 1000.0}
+	if err != nil {
+		return stats, "", stageErrMsg("preprocess", stderr, err)
+	}
+	stats.Lines = len(strings.Split(strings.TrimRight(stdout, "\n"), "\n"))
+	return stats, stdout, ""
+}
+
+func parseStage(ctx context.Context, srcFile string, extraArgs []string) (*StageStats, json.RawMessage, string) {
+	start := time.Now()
+	args := append([]string{"--dump-ast"}, extraArgs...)
+	args = append(args, "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/null", srcFile)
+	stdout, stderr, err := runCmd(ctx, chibiccBin, args...)
+	stats := &StageStats{TimeMs: float64(time.Since(start).Microseconds()) / 1000.0}
+	if err != nil {
+		return stats, json.RawMessage("null"), stageErrMsg("parse", stderr, err)
+	}
+	var astObj map[string]interface{}
+	if jsonErr := json.Unmarshal([]byte(stdout), &astObj); jsonErr == nil {
+		functions, globals := countFunctionsAndGlobals(astObj)
+		stats.Functions = functions
+		stats.Globals = globals
+		stats.Nodes = countASTNodes(astObj)
+	}
+	return stats, json.RawMessage(stdout), ""
+}
+
+func codegenStage(ctx context.Context, srcFile, asmFile string, extraArgs []string) (*StageStats, string, string) {
+	start := time.Now()
+	args := append([]string{"-S"}, extraArgs...)
+	args = append(args, "-o", asmFile, srcFile)
+	_, stderr, err := runCmd(ctx, chibiccBin, args...)
+	stats := &StageStats{TimeMs: float64(time.Since(start).Microseconds()) / 1000.0}
+	if err != nil {
+		return stats, "", stageErrMsg("codegen", stderr, err)
+	}
+	asmBytes, readErr := os.ReadFile(asmFile)
+	if readErr != nil {
+		return stats, "", fmt.Sprintf("codegen: failed to read output: %v", readErr)
+	}
+	stats.Lines = len(strings.Split(strings.TrimRight(string(asmBytes), "\n"), "\n"))
+	stats.Bytes = len(asmBytes)
+	return stats, string(asmBytes), ""
+}
+
+// stageErrMsg formats a stage failure, preferring chibicc's stderr and
+// falling back to the exec error when the subprocess produced nothing.
+func stageErrMsg(stage, stderr string, err error) string {
+	if s := strings.TrimSpace(stderr); s != "" {
+		return fmt.Sprintf("%s: %s", stage, s)
+	}
+	return fmt.Sprintf("%s: %v", stage, err)
+}
+
 // --- Compile handler ---
 
 func handleCompile(w http.ResponseWriter, r *http.Request) {
@@ -124,6 +254,14 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	key := cacheKey(req.Code, nil)
+	if cached, ok := globalCache.get(key); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "HIT")
+		json.NewEncoder(w).Encode(withCached(cached))
+		return
+	}
+
 	// Create temp directory for this compilation.
 	tmpDir, err := os.MkdirTemp("", "chibicc-explorer-*")
 	if err != nil {
@@ -146,87 +284,45 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 
 	var errors []string
 
+	// All four stages share one parent context, derived from the
+	// request's own context so a client disconnect (or the resolved
+	// deadline) kills every in-flight chibicc subprocess
+	// immediately instead of leaking them for up to the resolved timeout.
+	ctx, cancel := context.WithTimeout(r.Context(), resolveTimeout(r, req.TimeoutMs))
+	defer cancel()
+
 	// Stage 1: Tokenize (--dump-tokens)
 	{
-		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
-		defer cancel()
-		start := time.Now()
-		stdout, stderr, err := runCmd(ctx, chibiccBin,
-			"--dump-tokens", "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/null", srcFile)
-		elapsed := time.Since(start)
-
-		stats := &StageStats{TimeMs: float64(elapsed.Microseconds()) / 1000.0}
-		if err != nil {
-			msg := fmt.Sprintf("tokenize: %s", strings.TrimSpace(stderr))
-			if msg == "tokenize: " {
-				msg = fmt.Sprintf("tokenize: %v", err)
-			}
-			errors = append(errors, msg)
+		stats, tokens, errMsg := tokenizeStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			errors = append(errors, errMsg)
+			annotateStageErr(stats, ctx)
 		} else {
-			// stdout has the JSON token array
-			var tokens []interface{}
-			if jsonErr := json.Unmarshal([]byte(stdout), &tokens); jsonErr == nil {
-				stats.Count = len(tokens)
-				resp.Tokens = json.RawMessage(stdout)
-			} else {
-				// Maybe it's valid JSON but not an array; store raw
-				resp.Tokens = json.RawMessage(stdout)
-			}
+			resp.Tokens = tokens
 		}
 		resp.Stages["tokenize"] = stats
 	}
 
 	// Stage 2: Preprocess (-E)
 	{
-		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
-		defer cancel()
-		start := time.Now()
-		stdout, stderr, err := runCmd(ctx, chibiccBin,
-			"-E", "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/stdout", srcFile)
-		elapsed := time.Since(start)
-
-		stats := &StageStats{TimeMs: float64(elapsed.Microseconds()) / 1000.0}
-		if err != nil {
-			msg := fmt.Sprintf("preprocess: %s", strings.TrimSpace(stderr))
-			if msg == "preprocess: " {
-				msg = fmt.Sprintf("preprocess: %v", err)
-			}
-			errors = append(errors, msg)
+		stats, out, errMsg := preprocessStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			errors = append(errors, errMsg)
+			annotateStageErr(stats, ctx)
 		} else {
-			resp.Preprocessed = stdout
-			stats.Lines = len(strings.Split(strings.TrimRight(stdout, "\n"), "\n"))
+			resp.Preprocessed = out
 		}
 		resp.Stages["preprocess"] = stats
 	}
 
 	// Stage 3: Parse / AST (--dump-ast)
 	{
-		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
-		defer cancel()
-		start := time.Now()
-		stdout, stderr, err := runCmd(ctx, chibiccBin,
-			"--dump-ast", "-cc1", "-cc1-input", srcFile, "-cc1-output", "/dev/null", srcFile)
-		elapsed := time.Since(start)
-
-		stats := &StageStats{TimeMs: float64(elapsed.Microseconds()) / 1000.0}
-		if err != nil {
-			msg := fmt.Sprintf("parse: %s", strings.TrimSpace(stderr))
-			if msg == "parse: " {
-				msg = fmt.Sprintf("parse: %v", err)
-			}
-			errors = append(errors, msg)
+		stats, ast, errMsg := parseStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			errors = append(errors, errMsg)
+			annotateStageErr(stats, ctx)
 		} else {
-			var astObj map[string]interface{}
-			if jsonErr := json.Unmarshal([]byte(stdout), &astObj); jsonErr == nil {
-				functions, globals := countFunctionsAndGlobals(astObj)
-				stats.Functions = functions
-				stats.Globals = globals
-				stats.Nodes = countASTNodes(astObj)
-				resp.AST = json.RawMessage(stdout)
-			} else {
-				// Store raw even if we can't parse
-				resp.AST = json.RawMessage(stdout)
-			}
+			resp.AST = ast
 		}
 		resp.Stages["parse"] = stats
 	}
@@ -234,29 +330,12 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 	// Stage 4: Codegen (-S)
 	{
 		asmFile := filepath.Join(tmpDir, "output.s")
-		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
-		defer cancel()
-		start := time.Now()
-		_, stderr, err := runCmd(ctx, chibiccBin,
-			"-S", "-o", asmFile, srcFile)
-		elapsed := time.Since(start)
-
-		stats := &StageStats{TimeMs: float64(elapsed.Microseconds()) / 1000.0}
-		if err != nil {
-			msg := fmt.Sprintf("codegen: %s", strings.TrimSpace(stderr))
-			if msg == "codegen: " {
-				msg = fmt.Sprintf("codegen: %v", err)
-			}
-			errors = append(errors, msg)
+		stats, asm, errMsg := codegenStage(ctx, srcFile, asmFile, nil)
+		if errMsg != "" {
+			errors = append(errors, errMsg)
+			annotateStageErr(stats, ctx)
 		} else {
-			asmBytes, readErr := os.ReadFile(asmFile)
-			if readErr == nil {
-				resp.Assembly = string(asmBytes)
-				stats.Lines = len(strings.Split(strings.TrimRight(string(asmBytes), "\n"), "\n"))
-				stats.Bytes = len(asmBytes)
-			} else {
-				errors = append(errors, fmt.Sprintf("codegen: failed to read output: %v", readErr))
-			}
+			resp.Assembly = asm
 		}
 		resp.Stages["codegen"] = stats
 	}
@@ -265,21 +344,45 @@ func handleCompile(w http.ResponseWriter, r *http.Request) {
 	if len(errors) > 0 {
 		combined := strings.Join(errors, "\n")
 		resp.Error = &combined
+	} else {
+		globalCache.set(key, &resp)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("X-Cache", "MISS")
 	json.NewEncoder(w).Encode(resp)
 }
 
 func main() {
+	cacheSize := flag.Int("cache-size", 128, "max number of cached compile results kept in memory")
+	cacheTTL := flag.Duration("cache-ttl", 10*time.Minute, "how long a cached compile result stays valid")
+	cacheDisk := flag.Bool("cache-disk", false, "also persist cache entries under a tmp dir tier")
+	cacheDiskEntries := flag.Int("cache-disk-entries", 1000, "max number of files kept in the on-disk cache tier, oldest evicted first (0 disables the cap)")
+	allowNoAuth := flag.Bool("allow-no-auth", false, "allow starting on a non-loopback address with no auth token configured")
+	flag.Parse()
+
+	diskDir := ""
+	if *cacheDisk {
+		diskDir = filepath.Join(os.TempDir(), "chibicc-explorer-cache")
+	}
+	globalCache = newCompileCache(*cacheSize, *cacheTTL, diskDir, *cacheDiskEntries)
+
+	loadAuthConfig()
+	if authToken == "" && !isLoopbackAddr(listenAddr) && !*allowNoAuth {
+		log.Fatalf("refusing to start on non-loopback address %s with no auth token configured; set %s or pass -allow-no-auth", listenAddr, tokenEnvVar)
+	}
+
 	// Verify chibicc binary exists
 	if _, err := os.Stat(chibiccBin); os.IsNotExist(err) {
 		log.Fatalf("chibicc binary not found at %s", chibiccBin)
 	}
 
-	// API endpoint
-	http.HandleFunc("/api/compile", handleCompile)
+	// API endpoints
+	http.HandleFunc("/api/compile", withAuth(handleCompile))
+	http.HandleFunc("/api/compile/stream", withAuth(handleCompileStream))
+	http.HandleFunc("/api/build", withAuth(handleBuild))
+	http.HandleFunc("/api/cache/stats", withAuth(handleCacheStats))
+	http.HandleFunc("/api/cache/purge", withAuth(handleCachePurge))
 
 	// Static file server (for index.html, etc.)
 	fs := http.FileServer(http.Dir(staticDir))
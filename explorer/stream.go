@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// --- Streaming compile pipeline ---
+//
+// handleCompileStream runs the same four stages as handleCompile but
+// emits each one as an SSE event the moment it finishes instead of
+// buffering a single CompileResponse. tokenize, preprocess, and parse
+// all start from the same source file and run concurrently; codegen
+// waits on parse (it needs a successfully parsed AST) so wall-clock
+// time is roughly max(tokenize, preprocess, parse) + codegen rather
+// than the strictly-serial sum handleCompile pays.
+
+type stageEvent struct {
+	Tokens       json.RawMessage `json:"tokens,omitempty"`
+	Preprocessed string          `json:"preprocessed,omitempty"`
+	AST          json.RawMessage `json:"ast,omitempty"`
+	Assembly     string          `json:"assembly,omitempty"`
+	Stats        *StageStats     `json:"stats"`
+	Error        string          `json:"error,omitempty"`
+}
+
+func handleCompileStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	var req CompileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" {
+		http.Error(w, "empty code", http.StatusBadRequest)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "chibicc-explorer-*")
+	if err != nil {
+		http.Error(w, "failed to create temp dir", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcFile := filepath.Join(tmpDir, "input.c")
+	if err := os.WriteFile(srcFile, []byte(req.Code), 0644); err != nil {
+		http.Error(w, "failed to write temp file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := context.WithTimeout(r.Context(), resolveTimeout(r, req.TimeoutMs))
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		errMsgs []string
+	)
+
+	// emit serializes writes to w (required: multiple stage goroutines
+	// write concurrently) and records failures for the closing event.
+	emit := func(stage string, ev stageEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ev.Error != "" {
+			errMsgs = append(errMsgs, ev.Error)
+		}
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", stage, payload)
+		flusher.Flush()
+	}
+
+	parseOK := make(chan bool, 1)
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	go func() {
+		defer wg.Done()
+		stats, tokens, errMsg := tokenizeStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			annotateStageErr(stats, ctx)
+		}
+		emit("tokenize", stageEvent{Tokens: tokens, Stats: stats, Error: errMsg})
+	}()
+
+	go func() {
+		defer wg.Done()
+		stats, out, errMsg := preprocessStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			annotateStageErr(stats, ctx)
+		}
+		emit("preprocess", stageEvent{Preprocessed: out, Stats: stats, Error: errMsg})
+	}()
+
+	go func() {
+		defer wg.Done()
+		stats, ast, errMsg := parseStage(ctx, srcFile, nil)
+		if errMsg != "" {
+			annotateStageErr(stats, ctx)
+		}
+		emit("parse", stageEvent{AST: ast, Stats: stats, Error: errMsg})
+		parseOK <- errMsg == ""
+	}()
+
+	go func() {
+		defer wg.Done()
+		if !<-parseOK {
+			emit("codegen", stageEvent{Stats: &StageStats{}, Error: "codegen: skipped, parse failed"})
+			return
+		}
+		asmFile := filepath.Join(tmpDir, "output.s")
+		stats, asm, errMsg := codegenStage(ctx, srcFile, asmFile, nil)
+		if errMsg != "" {
+			annotateStageErr(stats, ctx)
+		}
+		emit("codegen", stageEvent{Assembly: asm, Stats: stats, Error: errMsg})
+	}()
+
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errMsgs) > 0 {
+		payload, _ := json.Marshal(struct {
+			Error string `json:"error"`
+		}{Error: strings.Join(errMsgs, "\n")})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", payload)
+	} else {
+		fmt.Fprintf(w, "event: done\ndata: {}\n\n")
+	}
+	flusher.Flush()
+}